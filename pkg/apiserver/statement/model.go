@@ -0,0 +1,69 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statement
+
+// Model is a row projected from INFORMATION_SCHEMA.CLUSTER_STATEMENTS_SUMMARY_HISTORY.
+// Only the columns referenced by the queries in this package are declared here;
+// `genSelectStmt` decides which of them are actually selected for a given request.
+type Model struct {
+	SchemaName string `json:"schema_name" gorm:"column:schema_name"`
+	Digest     string `json:"digest" gorm:"column:digest"`
+	DigestText string `json:"digest_text" gorm:"column:digest_text"`
+	TableNames string `json:"table_names" gorm:"column:table_names"`
+	StmtType   string `json:"stmt_type" gorm:"column:stmt_type"`
+	Plan       string `json:"plan" gorm:"column:plan"`
+	PlanDigest string `json:"plan_digest" gorm:"column:plan_digest"`
+
+	SumLatency int `json:"sum_latency" gorm:"column:agg_sum_latency"`
+	MaxLatency int `json:"max_latency" gorm:"column:max_latency"`
+	MinLatency int `json:"min_latency" gorm:"column:min_latency"`
+	AvgLatency int `json:"avg_latency" gorm:"column:avg_latency"`
+	ExecCount  int `json:"exec_count" gorm:"column:exec_count"`
+	SumMem     int `json:"sum_mem" gorm:"column:sum_mem"`
+	AvgMem     int `json:"avg_mem" gorm:"column:avg_mem"`
+	MaxMem     int `json:"max_mem" gorm:"column:max_mem"`
+}
+
+// TimeRange is a single statement summary retention window, expressed as
+// UTC epoch seconds.
+type TimeRange struct {
+	BeginTime int `json:"begin_time" gorm:"column:begin_time"`
+	EndTime   int `json:"end_time" gorm:"column:end_time"`
+}
+
+// Config is the statement summary configuration as read from / written to
+// the target TiDB cluster's system variables.
+type Config struct {
+	Enable          bool `json:"enable"`
+	RefreshInterval int  `json:"refresh_interval"`
+	HistorySize     int  `json:"history_size"`
+
+	// Persistent (file-rotated) statement summary, introduced alongside
+	// `tidb_enable_stmt_summary_persistent`. `EnablePersist` and the fields
+	// below are only meaningful when the cluster supports the feature, see
+	// `PersistSupported`.
+	EnablePersist    bool   `json:"enable_persist"`
+	PersistSupported bool   `json:"persist_supported"`
+	FilePath         string `json:"file_path"`
+	FileMaxDays      int    `json:"file_max_days"`
+	FileMaxSize      int    `json:"file_max_size"`
+	FileMaxBackups   int    `json:"file_max_backups"`
+}
+
+// Capabilities reports which optional statement summary features the
+// connected TiDB cluster understands, so that the frontend can conditionally
+// render controls for them.
+type Capabilities struct {
+	EnableStmtPersist bool `json:"enable_stmt_persist"`
+}
@@ -14,21 +14,62 @@
 package statement
 
 import (
+	"database/sql"
 	"fmt"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
 const (
-	statementsTable        = "INFORMATION_SCHEMA.CLUSTER_STATEMENTS_SUMMARY_HISTORY"
+	statementsTable = "INFORMATION_SCHEMA.CLUSTER_STATEMENTS_SUMMARY_HISTORY"
+	// persistedStmtHint steers a query at the rotated on-disk files written
+	// when tidb_enable_stmt_summary_persistent is on, instead of only the
+	// in-memory ring buffer. TiDB only honors optimizer hint comments
+	// immediately following the leading SELECT keyword, so this must be
+	// prepended to the select list, never appended to the table name.
+	persistedStmtHint      = "/*+ read_from_persisted_file() */"
 	stmtEnableVar          = "tidb_enable_stmt_summary"
 	stmtRefreshIntervalVar = "tidb_stmt_summary_refresh_interval"
 	stmtHistorySizeVar     = "tidb_stmt_summary_history_size"
+
+	// Persistent (file-rotated) statement summary, not available on every
+	// TiDB version the dashboard connects to.
+	stmtEnablePersistVar  = "tidb_enable_stmt_summary_persistent"
+	stmtFilePathVar       = "tidb_stmt_summary_filename"
+	stmtFileMaxDaysVar    = "tidb_stmt_summary_file_max_days"
+	stmtFileMaxSizeVar    = "tidb_stmt_summary_file_max_size"
+	stmtFileMaxBackupsVar = "tidb_stmt_summary_file_max_backups"
 )
 
+// unknownSysVarErr reports whether err is the "unknown system variable"
+// error MySQL/TiDB returns when a variable the caller asked for does not
+// exist on the connected version. Callers treat it as "feature unavailable"
+// rather than a hard failure.
+func unknownSysVarErr(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown system variable")
+}
+
+// sysVarExists probes whether a system variable is known to the connected
+// TiDB, without caring about its value. SHOW VARIABLES LIKE always returns
+// two columns (Variable_name, Value), so this scans a single row with Row()
+// rather than Pluck - Pluck's column selection is ignored on a Raw query in
+// gorm v1, which would otherwise fail to scan the real result set.
+func sysVarExists(db *gorm.DB, name string) (bool, error) {
+	var varName, value string
+	err := db.Raw("SHOW VARIABLES LIKE ?", name).Row().Scan(&varName, &value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // How to get sql variables by GORM
 // https://github.com/jinzhu/gorm/issues/2616
 func querySQLIntVariable(db *gorm.DB, name string) (int, error) {
@@ -49,6 +90,16 @@ func querySQLIntVariable(db *gorm.DB, name string) (int, error) {
 	return intVal, nil
 }
 
+func querySQLStringVariable(db *gorm.DB, name string) (string, error) {
+	var values []string
+	sql := fmt.Sprintf("SELECT @@GLOBAL.%s as value", name) // nolints
+	err := db.Raw(sql).Pluck("value", &values).Error
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
 func queryStmtConfig(db *gorm.DB) (*Config, error) {
 	config := Config{}
 
@@ -78,13 +129,51 @@ func queryStmtConfig(db *gorm.DB) (*Config, error) {
 		config.HistorySize = historySize
 	}
 
+	enablePersist, err := querySQLIntVariable(db, stmtEnablePersistVar)
+	if unknownSysVarErr(err) {
+		// The connected TiDB predates persistent stmtsummary; leave the
+		// persist fields at their zero values and report as unsupported.
+		return &config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.PersistSupported = true
+	config.EnablePersist = enablePersist != 0
+
+	filePath, err := querySQLStringVariable(db, stmtFilePathVar)
+	if err != nil {
+		return nil, err
+	}
+	config.FilePath = filePath
+
+	fileMaxDays, err := querySQLIntVariable(db, stmtFileMaxDaysVar)
+	if err != nil {
+		return nil, err
+	}
+	config.FileMaxDays = fileMaxDays
+
+	fileMaxSize, err := querySQLIntVariable(db, stmtFileMaxSizeVar)
+	if err != nil {
+		return nil, err
+	}
+	config.FileMaxSize = fileMaxSize
+
+	fileMaxBackups, err := querySQLIntVariable(db, stmtFileMaxBackupsVar)
+	if err != nil {
+		return nil, err
+	}
+	config.FileMaxBackups = fileMaxBackups
+
 	return &config, err
 }
 
 func updateStmtConfig(db *gorm.DB, config *Config) (err error) {
 	var sql string
 	sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtEnableVar)
-	err = db.Exec(sql, config.Enable).Error
+	if err = db.Exec(sql, config.Enable).Error; err != nil {
+		return
+	}
 
 	if config.Enable {
 		// update other configurations
@@ -95,23 +184,194 @@ func updateStmtConfig(db *gorm.DB, config *Config) (err error) {
 		}
 		sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtHistorySizeVar)
 		err = db.Exec(sql, config.HistorySize).Error
+		if err != nil {
+			return
+		}
+	}
+
+	supported, err := sysVarExists(db, stmtEnablePersistVar)
+	if err != nil || !supported {
+		// Nothing more to persist on clusters that don't know about it.
+		return
+	}
+
+	sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtEnablePersistVar)
+	if err = db.Exec(sql, config.EnablePersist).Error; err != nil {
+		return
+	}
+	if !config.EnablePersist {
+		return
+	}
+
+	sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtFilePathVar)
+	if err = db.Exec(sql, config.FilePath).Error; err != nil {
+		return
 	}
+	sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtFileMaxDaysVar)
+	if err = db.Exec(sql, config.FileMaxDays).Error; err != nil {
+		return
+	}
+	sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtFileMaxSizeVar)
+	if err = db.Exec(sql, config.FileMaxSize).Error; err != nil {
+		return
+	}
+	sql = fmt.Sprintf("SET GLOBAL %s = ?", stmtFileMaxBackupsVar)
+	err = db.Exec(sql, config.FileMaxBackups).Error
 	return
 }
 
-func queryTimeRanges(db *gorm.DB) (result []*TimeRange, err error) {
+// retentionSeconds returns how far back in-memory statement summary records
+// reach, derived from tidb_stmt_summary_refresh_interval *
+// tidb_stmt_summary_history_size. Records older than this are only
+// available once persisted to disk.
+func retentionSeconds(db *gorm.DB) (int, error) {
+	refreshInterval, err := querySQLIntVariable(db, stmtRefreshIntervalVar)
+	if err != nil {
+		return 0, err
+	}
+	if refreshInterval == -1 {
+		refreshInterval = 1800
+	}
+
+	historySize, err := querySQLIntVariable(db, stmtHistorySizeVar)
+	if err != nil {
+		return 0, err
+	}
+	if historySize == -1 {
+		historySize = 24
+	}
+
+	return refreshInterval * historySize, nil
+}
+
+// needsPersistedQuery reports whether beginTime reaches further back than
+// the in-memory retention window, and if so, whether the connected TiDB
+// actually supports reading persisted statement summary records at all. When
+// it doesn't, callers degrade to today's in-memory-only behavior.
+func needsPersistedQuery(db *gorm.DB, beginTime int) (bool, error) {
+	retention, err := retentionSeconds(db)
+	if err != nil {
+		return false, err
+	}
+	if beginTime >= int(time.Now().Unix())-retention {
+		return false, nil
+	}
+	return sysVarExists(db, stmtEnablePersistVar)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// minPositiveInt returns the smaller of two latencies, ignoring whichever
+// side is zero (no contribution rather than "faster than everything").
+func minPositiveInt(a, b int) int {
+	switch {
+	case a == 0:
+		return b
+	case b == 0:
+		return a
+	case a < b:
+		return a
+	default:
+		return b
+	}
+}
+
+// mergeModel combines two aggregates for the same statement/plan, as if they
+// had been aggregated together in the first place.
+func mergeModel(a, b Model) Model {
+	// a's identity fields (schema/digest/plan text, ...) win the merge, so
+	// make sure a is the non-empty side: a blank a would otherwise produce
+	// aggregates with no schema/digest/plan attached to them.
+	if a.Digest == "" && b.Digest != "" {
+		a, b = b, a
+	}
+
+	merged := a
+	merged.SumLatency = a.SumLatency + b.SumLatency
+	merged.SumMem = a.SumMem + b.SumMem
+	merged.ExecCount = a.ExecCount + b.ExecCount
+	merged.MaxLatency = maxInt(a.MaxLatency, b.MaxLatency)
+	merged.MinLatency = minPositiveInt(a.MinLatency, b.MinLatency)
+	if merged.ExecCount > 0 {
+		merged.AvgLatency = (a.AvgLatency*a.ExecCount + b.AvgLatency*b.ExecCount) / merged.ExecCount
+		merged.AvgMem = (a.AvgMem*a.ExecCount + b.AvgMem*b.ExecCount) / merged.ExecCount
+	}
+	merged.MaxMem = maxInt(a.MaxMem, b.MaxMem)
+	return merged
+}
+
+func findTimeRanges(db *gorm.DB, hint string) (result []*TimeRange, err error) {
+	selectStmt := `
+		DISTINCT
+		FLOOR(UNIX_TIMESTAMP(summary_begin_time)) AS begin_time,
+		FLOOR(UNIX_TIMESTAMP(summary_end_time)) AS end_time
+	`
+	if hint != "" {
+		selectStmt = hint + " " + selectStmt
+	}
 	err = db.
-		Select(`
-			DISTINCT
-			FLOOR(UNIX_TIMESTAMP(summary_begin_time)) AS begin_time,
-			FLOOR(UNIX_TIMESTAMP(summary_end_time)) AS end_time
-		`).
+		Select(selectStmt).
 		Table(statementsTable).
 		Order("begin_time DESC, end_time DESC").
 		Find(&result).Error
 	return
 }
 
+// mergeTimeRanges unions two sets of time ranges, de-duplicating identical
+// (begin_time, end_time) pairs coming from both the in-memory and persisted
+// sources.
+func mergeTimeRanges(memory, persisted []*TimeRange) []*TimeRange {
+	seen := make(map[TimeRange]struct{}, len(memory)+len(persisted))
+	result := make([]*TimeRange, 0, len(memory)+len(persisted))
+	for _, list := range [][]*TimeRange{memory, persisted} {
+		for _, tr := range list {
+			if _, ok := seen[*tr]; ok {
+				continue
+			}
+			seen[*tr] = struct{}{}
+			result = append(result, tr)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].BeginTime != result[j].BeginTime {
+			return result[i].BeginTime > result[j].BeginTime
+		}
+		return result[i].EndTime > result[j].EndTime
+	})
+	return result
+}
+
+// queryTimeRanges returns the available statement summary retention windows
+// as UTC epoch seconds, merging the in-memory and (if supported) persisted
+// sources.
+func (s *Service) queryTimeRanges(db *gorm.DB) (result []*TimeRange, err error) {
+	err = s.withSessionTimeZone(db, func(tx *gorm.DB) error {
+		memRanges, err := findTimeRanges(tx, "")
+		if err != nil {
+			return err
+		}
+
+		supported, err := sysVarExists(tx, stmtEnablePersistVar)
+		if err != nil || !supported {
+			result = memRanges
+			return err
+		}
+
+		persistedRanges, err := findTimeRanges(tx, persistedStmtHint)
+		if err != nil {
+			return err
+		}
+		result = mergeTimeRanges(memRanges, persistedRanges)
+		return nil
+	})
+	return result, err
+}
+
 func queryStmtTypes(db *gorm.DB) (result []string, err error) {
 	// why should put DISTINCT inside the `Pluck()` method, see here:
 	// https://github.com/jinzhu/gorm/issues/496
@@ -123,6 +383,36 @@ func queryStmtTypes(db *gorm.DB) (result []string, err error) {
 	return
 }
 
+// mergeStatements merges two aggregated-by-(schema_name, digest) result sets,
+// re-aggregating rows that appear on both sides.
+func mergeStatements(memory, persisted []Model) []Model {
+	type key struct{ schema, digest string }
+
+	index := make(map[key]*Model, len(memory)+len(persisted))
+	order := make([]key, 0, len(memory)+len(persisted))
+	for i := range memory {
+		k := key{memory[i].SchemaName, memory[i].Digest}
+		index[k] = &memory[i]
+		order = append(order, k)
+	}
+	for i := range persisted {
+		k := key{persisted[i].SchemaName, persisted[i].Digest}
+		if m, ok := index[k]; ok {
+			*m = mergeModel(*m, persisted[i])
+			continue
+		}
+		index[k] = &persisted[i]
+		order = append(order, k)
+	}
+
+	result := make([]Model, 0, len(order))
+	for _, k := range order {
+		result = append(result, *index[k])
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SumLatency > result[j].SumLatency })
+	return result
+}
+
 // sample params:
 // beginTime: 1586844000
 // endTime: 1586845800
@@ -136,53 +426,71 @@ func (s *Service) queryStatements(
 	text string,
 	reqFields []string,
 ) (result []Model, err error) {
-	tableColumns, err := s.params.SysSchema.GetTableColumnNames(db, statementsTable)
-	if err != nil {
-		return nil, err
-	}
+	err = s.withSessionTimeZone(db, func(tx *gorm.DB) error {
+		tableColumns, err := s.params.SysSchema.GetTableColumnNames(tx, statementsTable)
+		if err != nil {
+			return err
+		}
 
-	selectStmt, err := s.genSelectStmt(tableColumns, reqFields)
-	if err != nil {
-		return nil, err
-	}
+		selectStmt, err := s.genSelectStmt(tableColumns, reqFields)
+		if err != nil {
+			return err
+		}
 
-	query := db.
-		Select(selectStmt).
-		Table(statementsTable).
-		Where("summary_begin_time >= FROM_UNIXTIME(?) AND summary_end_time <= FROM_UNIXTIME(?)", beginTime, endTime).
-		Group("schema_name, digest").
-		Order("agg_sum_latency DESC")
+		predicates := stmtPredicates{
+			BeginTime: beginTime,
+			EndTime:   endTime,
+			Schemas:   schemas,
+			StmtTypes: stmtTypes,
+			Text:      text,
+		}
+		memPlan, persistedPlan, err := newStmtQueryPlans(tx, statementsTable, selectStmt, predicates, "schema_name, digest", "agg_sum_latency DESC")
+		if err != nil {
+			return err
+		}
 
-	if len(schemas) > 0 {
-		regex := make([]string, 0, len(schemas))
-		for _, schema := range schemas {
-			regex = append(regex, fmt.Sprintf("\\b%s\\.", regexp.QuoteMeta(schema)))
+		var memResult []Model
+		if err = memPlan.apply(tx).Find(&memResult).Error; err != nil {
+			return err
+		}
+		if persistedPlan == nil {
+			result = memResult
+			return nil
 		}
-		regexAll := strings.Join(regex, "|")
-		query = query.Where("table_names REGEXP ?", regexAll)
-	}
 
-	if len(stmtTypes) > 0 {
-		query = query.Where("stmt_type in (?)", stmtTypes)
-	}
+		var persistedResult []Model
+		if err = persistedPlan.apply(tx).Find(&persistedResult).Error; err != nil {
+			return err
+		}
+		result = mergeStatements(memResult, persistedResult)
+		return nil
+	})
+	return result, err
+}
 
-	if len(text) > 0 {
-		lowerText := strings.ToLower(text)
-		arr := strings.Fields(lowerText)
-		for _, v := range arr {
-			query = query.Where(
-				`LOWER(digest_text) REGEXP ?
-				 OR LOWER(digest) REGEXP ?
-				 OR LOWER(schema_name) REGEXP ?
-				 OR LOWER(table_names) REGEXP ?
-				 OR LOWER(plan) REGEXP ?`,
-				v, v, v, v, v,
-			)
+// mergePlans merges two aggregated-by-plan_digest result sets, re-aggregating
+// plans that appear on both sides.
+func mergePlans(memory, persisted []Model) []Model {
+	index := make(map[string]*Model, len(memory)+len(persisted))
+	order := make([]string, 0, len(memory)+len(persisted))
+	for i := range memory {
+		index[memory[i].PlanDigest] = &memory[i]
+		order = append(order, memory[i].PlanDigest)
+	}
+	for i := range persisted {
+		if m, ok := index[persisted[i].PlanDigest]; ok {
+			*m = mergeModel(*m, persisted[i])
+			continue
 		}
+		index[persisted[i].PlanDigest] = &persisted[i]
+		order = append(order, persisted[i].PlanDigest)
 	}
 
-	err = query.Find(&result).Error
-	return
+	result := make([]Model, 0, len(order))
+	for _, k := range order {
+		result = append(result, *index[k])
+	}
+	return result
 }
 
 func (s *Service) queryPlans(
@@ -190,37 +498,56 @@ func (s *Service) queryPlans(
 	beginTime, endTime int,
 	schemaName, digest string,
 ) (result []Model, err error) {
-	tableColumns, err := s.params.SysSchema.GetTableColumnNames(db, statementsTable)
-	if err != nil {
-		return nil, err
-	}
+	err = s.withSessionTimeZone(db, func(tx *gorm.DB) error {
+		tableColumns, err := s.params.SysSchema.GetTableColumnNames(tx, statementsTable)
+		if err != nil {
+			return err
+		}
 
-	selectStmt, err := s.genSelectStmt(tableColumns, []string{
-		"plan_digest",
-		"schema_name",
-		"digest_text",
-		"digest",
-		"sum_latency",
-		"max_latency",
-		"min_latency",
-		"avg_latency",
-		"exec_count",
-		"avg_mem",
-		"max_mem"})
-	if err != nil {
-		return nil, err
-	}
+		selectStmt, err := s.genSelectStmt(tableColumns, []string{
+			"plan_digest",
+			"schema_name",
+			"digest_text",
+			"digest",
+			"sum_latency",
+			"max_latency",
+			"min_latency",
+			"avg_latency",
+			"exec_count",
+			"avg_mem",
+			"max_mem"})
+		if err != nil {
+			return err
+		}
 
-	err = db.
-		Select(selectStmt).
-		Table(statementsTable).
-		Where("summary_begin_time >= FROM_UNIXTIME(?) AND summary_end_time <= FROM_UNIXTIME(?)", beginTime, endTime).
-		Where("schema_name = ?", schemaName).
-		Where("digest = ?", digest).
-		Group("plan_digest").
-		Find(&result).
-		Error
-	return
+		predicates := stmtPredicates{
+			BeginTime:  beginTime,
+			EndTime:    endTime,
+			SchemaName: schemaName,
+			Digest:     digest,
+		}
+		memPlan, persistedPlan, err := newStmtQueryPlans(tx, statementsTable, selectStmt, predicates, "plan_digest", "")
+		if err != nil {
+			return err
+		}
+
+		var memResult []Model
+		if err = memPlan.apply(tx).Find(&memResult).Error; err != nil {
+			return err
+		}
+		if persistedPlan == nil {
+			result = memResult
+			return nil
+		}
+
+		var persistedResult []Model
+		if err = persistedPlan.apply(tx).Find(&persistedResult).Error; err != nil {
+			return err
+		}
+		result = mergePlans(memResult, persistedResult)
+		return nil
+	})
+	return result, err
 }
 
 func (s *Service) queryPlanDetail(
@@ -229,25 +556,67 @@ func (s *Service) queryPlanDetail(
 	schemaName, digest string,
 	plans []string,
 ) (result Model, err error) {
-	tableColumns, err := s.params.SysSchema.GetTableColumnNames(db, statementsTable)
-	if err != nil {
-		return
-	}
+	err = s.withSessionTimeZone(db, func(tx *gorm.DB) error {
+		tableColumns, err := s.params.SysSchema.GetTableColumnNames(tx, statementsTable)
+		if err != nil {
+			return err
+		}
 
-	selectStmt, err := s.genSelectStmt(tableColumns, []string{"*"})
-	if err != nil {
-		return
-	}
+		selectStmt, err := s.genSelectStmt(tableColumns, []string{"*"})
+		if err != nil {
+			return err
+		}
 
-	query := db.
-		Select(selectStmt).
-		Table(statementsTable).
-		Where("summary_begin_time >= FROM_UNIXTIME(?) AND summary_end_time <= FROM_UNIXTIME(?)", beginTime, endTime).
-		Where("schema_name = ?", schemaName).
-		Where("digest = ?", digest)
-	if len(plans) > 0 {
-		query = query.Where("plan_digest in (?)", plans)
-	}
-	err = query.Scan(&result).Error
-	return
+		predicates := stmtPredicates{
+			BeginTime:   beginTime,
+			EndTime:     endTime,
+			SchemaName:  schemaName,
+			Digest:      digest,
+			PlanDigests: plans,
+		}
+		memPlan, persistedPlan, err := newStmtQueryPlans(tx, statementsTable, selectStmt, predicates, "", "")
+		if err != nil {
+			return err
+		}
+
+		// Scan into a non-slice struct reports gorm.ErrRecordNotFound when
+		// zero rows match, which is the normal outcome here whenever the
+		// requested digest only lives in the persisted source (beginTime
+		// entirely outside in-memory retention) - that's not a failure on
+		// its own, only both sides coming up empty is.
+		memFound := true
+		if err = memPlan.apply(tx).Scan(&result).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				return err
+			}
+			memFound = false
+		}
+
+		if persistedPlan == nil {
+			if !memFound {
+				return gorm.ErrRecordNotFound
+			}
+			return nil
+		}
+
+		var persisted Model
+		persFound := true
+		if err = persistedPlan.apply(tx).Scan(&persisted).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				return err
+			}
+			persFound = false
+		}
+
+		switch {
+		case !memFound && !persFound:
+			return gorm.ErrRecordNotFound
+		case !memFound:
+			result = persisted
+		case persFound:
+			result = mergeModel(result, persisted)
+		}
+		return nil
+	})
+	return result, err
 }
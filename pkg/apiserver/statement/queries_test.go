@@ -0,0 +1,145 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statement
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/require"
+)
+
+// nopSysSchema satisfies SysSchema without touching the database, for tests
+// that only exercise the "*" select path and don't care which columns exist.
+type nopSysSchema struct{}
+
+func (nopSysSchema) GetTableColumnNames(db *gorm.DB, tableName string) ([]string, error) {
+	return nil, nil
+}
+
+func TestSysVarExistsFound(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	// SHOW VARIABLES LIKE always returns both columns; a sysVarExists
+	// regression that only scans one (e.g. via Pluck on a Raw query, which
+	// silently ignores the column selection) fails to scan this row at all.
+	mock.ExpectQuery(`SHOW VARIABLES LIKE \?`).
+		WithArgs(stmtEnablePersistVar).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}).
+			AddRow(stmtEnablePersistVar, "1"))
+
+	exists, err := sysVarExists(db, stmtEnablePersistVar)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestSysVarExistsNotFound(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SHOW VARIABLES LIKE \?`).
+		WithArgs(stmtEnablePersistVar).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}))
+
+	exists, err := sysVarExists(db, stmtEnablePersistVar)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestQueryTimeRangesSetsSessionTimeZone(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	s := NewService(Params{TimeZone: "Asia/Shanghai"})
+
+	// SET time_zone and the queries that rely on it must run inside the same
+	// transaction: a bare SET on a pooled connection has no guarantee the
+	// following queries land on that same physical connection, so pinning
+	// them to one transaction is what actually closes the bug. sqlmock
+	// models a single connection regardless, so asserting Begin/Commit
+	// bracket every statement is the strongest check this driver allows.
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET time_zone = \?`).
+		WithArgs("Asia/Shanghai").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`FLOOR\(UNIX_TIMESTAMP`).
+		WillReturnRows(sqlmock.NewRows([]string{"begin_time", "end_time"}))
+	mock.ExpectQuery(`SHOW VARIABLES LIKE`).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}))
+	mock.ExpectCommit()
+
+	_, err := s.queryTimeRanges(db)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestQueryTimeRangesRollsBackOnError asserts that a failure partway through
+// the pinned transaction is rolled back rather than left open, which would
+// otherwise leak a connection stuck on the wrong session time zone back into
+// the pool.
+func TestQueryTimeRangesRollsBackOnError(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	s := NewService(Params{TimeZone: "Asia/Shanghai"})
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET time_zone = \?`).
+		WithArgs("Asia/Shanghai").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`FLOOR\(UNIX_TIMESTAMP`).
+		WillReturnError(fmt.Errorf("connection reset"))
+	mock.ExpectRollback()
+
+	_, err := s.queryTimeRanges(db)
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestQueryPlanDetailFallsBackToPersistedWhenNoInMemoryRow asserts that a
+// digest with no in-memory row (beginTime entirely outside retention) still
+// resolves from the persisted source, rather than failing on the in-memory
+// Scan's gorm.ErrRecordNotFound.
+func TestQueryPlanDetailFallsBackToPersistedWhenNoInMemoryRow(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	s := NewService(Params{SysSchema: nopSysSchema{}, TimeZone: "UTC"})
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET time_zone = \?`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT @@GLOBAL.tidb_stmt_summary_refresh_interval`).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("1800"))
+	mock.ExpectQuery(`SELECT @@GLOBAL.tidb_stmt_summary_history_size`).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("24"))
+	mock.ExpectQuery(`SHOW VARIABLES LIKE`).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}).
+			AddRow(stmtEnablePersistVar, "1"))
+	// In-memory source has no row for a digest this old.
+	mock.ExpectQuery(`INFORMATION_SCHEMA`).
+		WillReturnRows(sqlmock.NewRows([]string{"digest"}))
+	// Persisted source has it.
+	mock.ExpectQuery(`read_from_persisted_file`).
+		WillReturnRows(sqlmock.NewRows([]string{"digest"}).AddRow("abcd"))
+	mock.ExpectCommit()
+
+	result, err := s.queryPlanDetail(db, 1, 2, "test", "abcd", nil)
+	require.NoError(t, err)
+	require.Equal(t, "abcd", result.Digest)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
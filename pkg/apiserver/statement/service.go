@@ -0,0 +1,127 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statement
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SysSchema abstracts INFORMATION_SCHEMA lookups so that the statement
+// queries can validate requested fields against the columns the connected
+// TiDB actually exposes.
+type SysSchema interface {
+	GetTableColumnNames(db *gorm.DB, tableName string) ([]string, error)
+}
+
+// Params holds everything the statement Service needs that isn't carried on
+// individual requests.
+type Params struct {
+	SysSchema SysSchema
+
+	// TimeZone is applied to every statement summary session via
+	// `SET time_zone = ?` so that `summary_begin_time`/`summary_end_time`
+	// (which TiDB stores and converts in the session time zone) are always
+	// interpreted the same way regardless of the server's local settings.
+	// Defaults to "UTC".
+	TimeZone string
+}
+
+// Service serves the statement summary APIs.
+type Service struct {
+	params Params
+}
+
+// NewService creates a statement Service.
+func NewService(params Params) *Service {
+	if params.TimeZone == "" {
+		params.TimeZone = "UTC"
+	}
+	return &Service{params: params}
+}
+
+// genSelectStmt builds the `SELECT` column list for a statement summary
+// query, restricted to the columns requested by the caller and present on
+// the target table. `sum_latency` is summed and aliased to `agg_sum_latency`,
+// which the `GROUP BY schema_name, digest` query orders by; every other
+// requested field is selected as-is, without aggregation.
+func (s *Service) genSelectStmt(tableColumns, reqFields []string) (string, error) {
+	if len(reqFields) == 1 && reqFields[0] == "*" {
+		return "*", nil
+	}
+
+	columnSet := make(map[string]struct{}, len(tableColumns))
+	for _, c := range tableColumns {
+		columnSet[c] = struct{}{}
+	}
+
+	fields := make([]string, 0, len(reqFields))
+	for _, f := range reqFields {
+		if _, ok := columnSet[f]; !ok {
+			return "", fmt.Errorf("field %s is not found in %s", f, statementsTable)
+		}
+		switch f {
+		case "sum_latency":
+			fields = append(fields, "SUM(sum_latency) AS agg_sum_latency")
+		default:
+			fields = append(fields, f)
+		}
+	}
+	return strings.Join(fields, ","), nil
+}
+
+// setSessionTimeZone pins the GORM session's `time_zone` to `s.params.TimeZone`
+// before a statement summary query runs. `summary_begin_time`/
+// `summary_end_time` are TIMESTAMP columns, so TiDB converts them using the
+// session time zone; without this, a dashboard process whose local time zone
+// disagrees with the session default would see rows shift by hours or miss
+// boundary buckets entirely.
+func (s *Service) setSessionTimeZone(db *gorm.DB) error {
+	return db.Exec("SET time_zone = ?", s.params.TimeZone).Error
+}
+
+// withSessionTimeZone runs fn against a connection pinned to
+// `s.params.TimeZone`. A bare `db.Exec("SET time_zone = ...")` on a pooled
+// `*gorm.DB` gives no guarantee that a later `Find`/`Scan` on the same db
+// reuses that physical connection, so the session time zone it silently
+// reads could be whatever a previous, never-`SET` connection left behind.
+// Wrapping both in a transaction pins them to one connection for its
+// lifetime.
+func (s *Service) withSessionTimeZone(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := s.setSessionTimeZone(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// GetCapabilities probes the connected TiDB for optional statement summary
+// features so that the frontend can conditionally show controls for them.
+func (s *Service) GetCapabilities(db *gorm.DB) (*Capabilities, error) {
+	supported, err := sysVarExists(db, stmtEnablePersistVar)
+	if err != nil {
+		return nil, err
+	}
+	return &Capabilities{EnableStmtPersist: supported}, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statement
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// stmtTextColumns are the columns searched when a caller supplies free-text
+// keywords, in the same order the legacy hand-rolled query used them.
+var stmtTextColumns = []string{"digest_text", "digest", "schema_name", "table_names", "plan"}
+
+// regexMetaChars matches characters that give a keyword regexp meaning. A
+// token without any of these is a plain substring and can be looked up with
+// INSTR, which is cheaper and more index/file-prune-friendly than REGEXP.
+var regexMetaChars = regexp.MustCompile(`[.*+?^${}()|\[\]\\]`)
+
+// stmtPredicates collects the structured filters a statement summary query
+// can be narrowed by. It is the single source of truth `stmtQueryPlan` reads
+// from, instead of each query function re-deriving `Where` clauses by hand.
+type stmtPredicates struct {
+	BeginTime int
+	EndTime   int
+
+	Schemas   []string // schema_name, matched against table_names
+	StmtTypes []string
+	Text      string // free-text keywords, space separated
+
+	// SchemaName/Digest are exact-match filters used by the per-statement
+	// plan queries, as opposed to Schemas above which filters a whole list.
+	SchemaName  string
+	Digest      string
+	PlanDigests []string
+}
+
+// stmtQueryPlan is a fully-specified statement summary query: which table to
+// read from, which optimizer hint (if any) steers it at the persisted
+// on-disk source instead of the in-memory ring buffer, which columns to
+// project, and which predicates/grouping/ordering to apply. Build one with
+// `newStmtQueryPlans`, which also decides whether the persisted source needs
+// querying at all. `queryStatements`, `queryPlans` and `queryPlanDetail` each
+// use this instead of hand-rolling the GORM chain, so the filter, text-search
+// and source-selection logic only needs to be right once.
+type stmtQueryPlan struct {
+	Table      string
+	Select     string
+	Hint       string
+	Predicates stmtPredicates
+	GroupBy    string
+	OrderBy    string
+}
+
+// apply chains the plan's projection, predicates, grouping and ordering onto
+// db, ready for `Find`/`Scan`. TiDB only recognizes an optimizer hint
+// comment when it immediately follows the leading `SELECT` keyword, so the
+// hint (if any) is prepended to the select list rather than appended to the
+// table name.
+func (p *stmtQueryPlan) apply(db *gorm.DB) *gorm.DB {
+	selectStmt := p.Select
+	if p.Hint != "" {
+		selectStmt = p.Hint + " " + selectStmt
+	}
+
+	query := db.
+		Select(selectStmt).
+		Table(p.Table).
+		Where("summary_begin_time >= FROM_UNIXTIME(?) AND summary_end_time <= FROM_UNIXTIME(?)", p.Predicates.BeginTime, p.Predicates.EndTime)
+
+	if len(p.Predicates.Schemas) > 0 {
+		regex := make([]string, 0, len(p.Predicates.Schemas))
+		for _, schema := range p.Predicates.Schemas {
+			regex = append(regex, fmt.Sprintf(`\b%s\.`, regexp.QuoteMeta(schema)))
+		}
+		query = query.Where("table_names REGEXP ?", strings.Join(regex, "|"))
+	}
+
+	if p.Predicates.SchemaName != "" {
+		query = query.Where("schema_name = ?", p.Predicates.SchemaName)
+	}
+
+	if p.Predicates.Digest != "" {
+		query = query.Where("digest = ?", p.Predicates.Digest)
+	}
+
+	if len(p.Predicates.StmtTypes) > 0 {
+		query = query.Where("stmt_type in (?)", p.Predicates.StmtTypes)
+	}
+
+	if len(p.Predicates.PlanDigests) > 0 {
+		query = query.Where("plan_digest in (?)", p.Predicates.PlanDigests)
+	}
+
+	for _, token := range strings.Fields(strings.ToLower(p.Predicates.Text)) {
+		clause, args := stmtTextWhere(token)
+		query = query.Where(clause, args...)
+	}
+
+	if p.GroupBy != "" {
+		query = query.Group(p.GroupBy)
+	}
+	if p.OrderBy != "" {
+		query = query.Order(p.OrderBy)
+	}
+	return query
+}
+
+// newStmtQueryPlans builds the in-memory query plan and, when beginTime
+// reaches further back than the in-memory retention window and the
+// connected TiDB supports reading persisted records, a second plan hinted at
+// that persisted source. The second return value is nil whenever the
+// in-memory source alone covers the requested window, or the cluster can't
+// read persisted records at all, so callers can skip the second query and
+// the merge it requires.
+func newStmtQueryPlans(
+	db *gorm.DB,
+	table, selectStmt string,
+	predicates stmtPredicates,
+	groupBy, orderBy string,
+) (mem, persisted *stmtQueryPlan, err error) {
+	mem = &stmtQueryPlan{
+		Table:      table,
+		Select:     selectStmt,
+		Predicates: predicates,
+		GroupBy:    groupBy,
+		OrderBy:    orderBy,
+	}
+
+	needPersisted, err := needsPersistedQuery(db, predicates.BeginTime)
+	if err != nil || !needPersisted {
+		return mem, nil, err
+	}
+
+	persisted = &stmtQueryPlan{
+		Table:      table,
+		Select:     selectStmt,
+		Hint:       persistedStmtHint,
+		Predicates: predicates,
+		GroupBy:    groupBy,
+		OrderBy:    orderBy,
+	}
+	return mem, persisted, nil
+}
+
+// stmtTextWhere builds the OR'd predicate matching a single keyword against
+// all searchable columns, preferring `INSTR` for plain substrings and only
+// falling back to `REGEXP` when the token carries regex metacharacters.
+func stmtTextWhere(token string) (string, []interface{}) {
+	clauses := make([]string, 0, len(stmtTextColumns))
+	args := make([]interface{}, 0, len(stmtTextColumns))
+	for _, col := range stmtTextColumns {
+		if regexMetaChars.MatchString(token) {
+			clauses = append(clauses, fmt.Sprintf("LOWER(%s) REGEXP ?", col))
+		} else {
+			clauses = append(clauses, fmt.Sprintf("INSTR(LOWER(%s), ?) > 0", col))
+		}
+		args = append(args, token)
+	}
+	return strings.Join(clauses, " OR "), args
+}
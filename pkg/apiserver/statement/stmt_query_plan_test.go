@@ -0,0 +1,175 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statement
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/require"
+)
+
+func mockStmtDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock, func()) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+
+	db, err := gorm.Open("mysql", sqlDB)
+	require.NoError(t, err)
+
+	return db, mock, func() {
+		_ = sqlDB.Close()
+	}
+}
+
+func TestStmtQueryPlanTextSearch(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	plan := &stmtQueryPlan{
+		Table:  statementsTable,
+		Select: "digest_text, digest",
+		Predicates: stmtPredicates{
+			BeginTime: 1586844000,
+			EndTime:   1586845800,
+			Text:      "tpcc select.*",
+		},
+		GroupBy: "schema_name, digest",
+		OrderBy: "agg_sum_latency DESC",
+	}
+
+	// "tpcc" has no regex metacharacters and should be pushed down as
+	// INSTR; "select.*" does and should fall back to REGEXP.
+	mock.ExpectQuery(`INSTR\(LOWER\(digest_text\), \?\) > 0.*LOWER\(digest_text\) REGEXP \?`).
+		WillReturnRows(sqlmock.NewRows([]string{"digest_text", "digest"}))
+
+	var result []Model
+	err := plan.apply(db).Find(&result).Error
+	require.NoError(t, err)
+}
+
+func TestStmtQueryPlanSchemaAndStmtTypeFilters(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	plan := &stmtQueryPlan{
+		Table:  statementsTable,
+		Select: "digest_text",
+		Predicates: stmtPredicates{
+			BeginTime: 1,
+			EndTime:   2,
+			Schemas:   []string{"tpcc", "test"},
+			StmtTypes: []string{"select", "update"},
+		},
+	}
+
+	mock.ExpectQuery(`table_names REGEXP \?.*stmt_type in \(\?,\?\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"digest_text"}))
+
+	var result []Model
+	err := plan.apply(db).Find(&result).Error
+	require.NoError(t, err)
+}
+
+func TestStmtQueryPlanPersistedHintFollowsSelect(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	plan := &stmtQueryPlan{
+		Table:  statementsTable,
+		Select: "digest_text, digest",
+		Hint:   persistedStmtHint,
+		Predicates: stmtPredicates{
+			BeginTime: 1,
+			EndTime:   2,
+		},
+	}
+
+	// TiDB only honors an optimizer hint comment immediately after the
+	// leading SELECT keyword, so it must precede the column list, not
+	// trail the FROM table name. The assertion stops at "FROM" rather than
+	// also pinning down the table name's exact quoting, since gorm quotes
+	// identifiers (e.g. `INFORMATION_SCHEMA`.`CLUSTER_STATEMENTS_...`) in a
+	// way unrelated to what this test is checking.
+	hint := regexp.QuoteMeta(persistedStmtHint)
+	mock.ExpectQuery(`^SELECT ` + hint + ` digest_text, digest FROM`).
+		WillReturnRows(sqlmock.NewRows([]string{"digest_text", "digest"}))
+
+	var result []Model
+	err := plan.apply(db).Find(&result).Error
+	require.NoError(t, err)
+}
+
+func TestNewStmtQueryPlansSkipsPersistedWhenWithinRetention(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT @@GLOBAL.tidb_stmt_summary_refresh_interval`).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("1800"))
+	mock.ExpectQuery(`SELECT @@GLOBAL.tidb_stmt_summary_history_size`).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("24"))
+
+	now := int(time.Now().Unix())
+	predicates := stmtPredicates{BeginTime: now, EndTime: now}
+	mem, persisted, err := newStmtQueryPlans(db, statementsTable, "digest", predicates, "", "")
+	require.NoError(t, err)
+	require.NotNil(t, mem)
+	require.Nil(t, persisted)
+	require.Empty(t, mem.Hint)
+}
+
+func TestNewStmtQueryPlansAddsPersistedWhenBeyondRetention(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT @@GLOBAL.tidb_stmt_summary_refresh_interval`).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("1800"))
+	mock.ExpectQuery(`SELECT @@GLOBAL.tidb_stmt_summary_history_size`).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("24"))
+	mock.ExpectQuery(`SHOW VARIABLES LIKE`).
+		WillReturnRows(sqlmock.NewRows([]string{"Variable_name", "Value"}).AddRow("tidb_enable_stmt_summary_persistent", "1"))
+
+	predicates := stmtPredicates{BeginTime: 1, EndTime: 2}
+	mem, persisted, err := newStmtQueryPlans(db, statementsTable, "digest", predicates, "", "")
+	require.NoError(t, err)
+	require.NotNil(t, mem)
+	require.NotNil(t, persisted)
+	require.Equal(t, persistedStmtHint, persisted.Hint)
+}
+
+func TestStmtQueryPlanExactMatchFilters(t *testing.T) {
+	db, mock, cleanup := mockStmtDB(t)
+	defer cleanup()
+
+	plan := &stmtQueryPlan{
+		Table:  statementsTable,
+		Select: "*",
+		Predicates: stmtPredicates{
+			BeginTime:   1,
+			EndTime:     2,
+			SchemaName:  "tpcc",
+			Digest:      "abcd",
+			PlanDigests: []string{"p1", "p2"},
+		},
+	}
+
+	mock.ExpectQuery(`schema_name = \?.*digest = \?.*plan_digest in \(\?,\?\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"digest"}).AddRow("abcd"))
+
+	var result Model
+	err := plan.apply(db).Scan(&result).Error
+	require.NoError(t, err)
+}
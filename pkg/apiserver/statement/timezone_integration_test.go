@@ -0,0 +1,58 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build integration
+
+package statement
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTimeRangesAreTimeZoneIndependent asserts that `queryTimeRanges` returns
+// identical bucket boundaries whether `Service.TimeZone` (and so the TiDB
+// session's `time_zone`) is `UTC` or `Asia/Shanghai`. Requires a live
+// cluster reachable via TIDB_DASHBOARD_TEST_DSN,
+// so it's excluded from the default `go test ./...` run.
+func TestTimeRangesAreTimeZoneIndependent(t *testing.T) {
+	dsn := os.Getenv("TIDB_DASHBOARD_TEST_DSN")
+	if dsn == "" {
+		t.Skip("set TIDB_DASHBOARD_TEST_DSN to run against a live cluster")
+	}
+
+	db, err := gorm.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+
+	utcService := NewService(Params{SysSchema: sysSchemaStub{}, TimeZone: "UTC"})
+	shanghaiService := NewService(Params{SysSchema: sysSchemaStub{}, TimeZone: "Asia/Shanghai"})
+
+	utcRanges, err := utcService.queryTimeRanges(db)
+	require.NoError(t, err)
+
+	shanghaiRanges, err := shanghaiService.queryTimeRanges(db)
+	require.NoError(t, err)
+
+	require.Equal(t, utcRanges, shanghaiRanges)
+}
+
+type sysSchemaStub struct{}
+
+func (sysSchemaStub) GetTableColumnNames(db *gorm.DB, tableName string) ([]string, error) {
+	return nil, nil
+}